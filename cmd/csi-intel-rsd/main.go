@@ -0,0 +1,76 @@
+// Copyright 2019 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	csirsd "github.com/intel/csi-intel-rsd/internal"
+	"github.com/intel/csi-intel-rsd/pkg/rsd"
+	"k8s.io/klog"
+)
+
+// shutdownGracePeriod bounds how long Stop waits for in-flight RPCs to
+// drain after a SIGINT/SIGTERM before forcing the gRPC servers down.
+const shutdownGracePeriod = 30 * time.Second
+
+func main() {
+	klog.InitFlags(nil)
+
+	var (
+		nodeEndpoint       = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/"+csirsd.DriverName+"/csi.sock", "CSI node endpoint, used by kubelet")
+		controllerEndpoint = flag.String("controller-endpoint", os.Getenv(csirsd.ControllerEndpointEnvVar), "CSI controller endpoint; defaults to "+csirsd.ControllerEndpointEnvVar)
+		csiAddonsEndpoint  = flag.String("csi-addons-endpoint", "unix:///tmp/csi-addons.sock", "CSI-Addons endpoint for out-of-band RSD operations; empty disables it")
+		mode               = flag.String("mode", string(csirsd.ModeAll), "driver mode: controller, node, or all")
+		nodeID             = flag.String("nodeid", "", "node ID reported to the CSI external-attacher")
+		rsdPodmURL         = flag.String("rsd-podm-endpoint", "", "address of the RSD PodM REST API")
+	)
+	flag.Parse()
+	defer klog.Flush()
+
+	if *controllerEndpoint == "" {
+		*controllerEndpoint = *nodeEndpoint
+	}
+
+	rsdClient, err := rsd.NewClient(*rsdPodmURL)
+	if err != nil {
+		log.Fatalf("failed to create RSD client: %v", err)
+	}
+
+	drv := csirsd.NewDriver(*controllerEndpoint, *nodeEndpoint, *csiAddonsEndpoint, *nodeID, csirsd.Mode(*mode), rsdClient)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Printf("received shutdown signal, draining in-flight RPCs")
+		stopCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		if err := drv.Stop(stopCtx); err != nil {
+			log.Printf("error stopping driver: %v", err)
+		}
+	}()
+
+	if err := drv.Run(); err != nil {
+		log.Printf("driver exited with error: %v", err)
+		os.Exit(1)
+	}
+}
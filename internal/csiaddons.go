@@ -0,0 +1,115 @@
+// Copyright 2019 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csirsd
+
+import (
+	osexec "os/exec"
+
+	"github.com/csi-addons/spec/lib/go/fence"
+	"github.com/csi-addons/spec/lib/go/identity"
+	"github.com/csi-addons/spec/lib/go/reclaimspace"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetIdentity implements the CSI-Addons identity service, reusing the same
+// driver name and version reported on the main CSI socket.
+func (drv *Driver) GetIdentity(ctx context.Context, req *identity.GetIdentityRequest) (*identity.GetIdentityResponse, error) {
+	return &identity.GetIdentityResponse{
+		Name:    DriverName,
+		Version: DriverVersion,
+	}, nil
+}
+
+// GetCapabilities advertises the CSI-Addons services this driver supports on
+// the CSI-Addons endpoint.
+func (drv *Driver) GetCapabilities(ctx context.Context, req *identity.GetCapabilitiesRequest) (*identity.GetCapabilitiesResponse, error) {
+	return &identity.GetCapabilitiesResponse{
+		Capabilities: []*identity.Capability{
+			{
+				Type: &identity.Capability_Service_{
+					Service: &identity.Capability_Service{Type: identity.Capability_Service_RECLAIM_SPACE},
+				},
+			},
+			{
+				Type: &identity.Capability_Service_{
+					Service: &identity.Capability_Service{Type: identity.Capability_Service_NETWORK_FENCE},
+				},
+			},
+		},
+	}, nil
+}
+
+// ControllerReclaimSpace calls the RSD PodM API directly, without a node's
+// staging mount to run fstrim against.
+func (drv *Driver) ControllerReclaimSpace(ctx context.Context, req *reclaimspace.ControllerReclaimSpaceRequest) (*reclaimspace.ControllerReclaimSpaceResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if err := drv.rsdClient.ReclaimSpace(ctx, volumeID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reclaim space on volume %s: %v", volumeID, err)
+	}
+
+	return &reclaimspace.ControllerReclaimSpaceResponse{}, nil
+}
+
+// NodeReclaimSpace runs fstrim against the filesystem already mounted at
+// StagingTargetPath, rather than going through the RSD PodM API: the node
+// has the volume mounted locally, so issuing the discard there avoids a
+// round trip through the controller for every reclaim call.
+func (drv *Driver) NodeReclaimSpace(ctx context.Context, req *reclaimspace.NodeReclaimSpaceRequest) (*reclaimspace.NodeReclaimSpaceResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	if out, err := osexec.Command("fstrim", stagingPath).CombinedOutput(); err != nil {
+		return nil, status.Errorf(codes.Internal, "fstrim failed on %s: %v: %s", stagingPath, err, out)
+	}
+
+	return &reclaimspace.NodeReclaimSpaceResponse{}, nil
+}
+
+// NetworkFence drops the given CIDRs from the RSD endpoint's initiator ACL.
+func (drv *Driver) NetworkFence(ctx context.Context, req *fence.NetworkFenceRequest) (*fence.NetworkFenceResponse, error) {
+	if len(req.GetCidrs()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no CIDRs given to fence")
+	}
+
+	if err := drv.rsdClient.FenceInitiators(ctx, req.GetCidrs()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to fence initiators: %v", err)
+	}
+
+	return &fence.NetworkFenceResponse{}, nil
+}
+
+// NetworkUnFence re-adds the given CIDRs to the RSD endpoint's initiator ACL.
+func (drv *Driver) NetworkUnFence(ctx context.Context, req *fence.NetworkFenceRequest) (*fence.NetworkFenceResponse, error) {
+	if len(req.GetCidrs()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no CIDRs given to unfence")
+	}
+
+	if err := drv.rsdClient.UnfenceInitiators(ctx, req.GetCidrs()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unfence initiators: %v", err)
+	}
+
+	return &fence.NetworkFenceResponse{}, nil
+}
@@ -25,6 +25,9 @@ import (
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/csi-addons/spec/lib/go/fence"
+	"github.com/csi-addons/spec/lib/go/identity"
+	"github.com/csi-addons/spec/lib/go/reclaimspace"
 	"github.com/intel/csi-intel-rsd/pkg/rsd"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -37,6 +40,31 @@ const (
 
 	// DriverVersion defines current CSI Driver version
 	DriverVersion = "0.0.1"
+
+	// ControllerEndpointEnvVar is the environment variable consulted for the
+	// controller gRPC endpoint when no CLI flag is given, so the controller
+	// and node endpoints can be configured independently in a split
+	// deployment.
+	ControllerEndpointEnvVar = "CSI_CONTROLLER_ENDPOINT"
+)
+
+// Mode selects which gRPC services a Driver instance registers, so that the
+// same binary can be deployed both as the controller sidecar and as the
+// per-node sidecar.
+type Mode string
+
+const (
+	// ModeController serves only IdentityServer and ControllerServer, on
+	// controllerEndpoint.
+	ModeController Mode = "controller"
+	// ModeNode serves only IdentityServer and NodeServer, on nodeEndpoint.
+	ModeNode Mode = "node"
+	// ModeAll serves Identity+Controller+Node. If controllerEndpoint and
+	// nodeEndpoint differ, each is served on its own socket concurrently;
+	// if they're the same path (the default single-socket deployment), one
+	// combined server is bound instead of binding that path twice. This is
+	// the default mode.
+	ModeAll Mode = "all"
 )
 
 // Driver implements the following CSI interfaces:
@@ -46,8 +74,18 @@ const (
 //   csi.NodeServer
 //
 type Driver struct {
-	endpoint string
-	srv      *grpc.Server
+	mode Mode
+
+	controllerEndpoint string
+	nodeEndpoint       string
+	csiAddonsEndpoint  string
+
+	controllerSrv *grpc.Server
+	nodeSrv       *grpc.Server
+	csiAddonsSrv  *grpc.Server
+	srvMu         sync.Mutex // protects controllerSrv, nodeSrv, csiAddonsSrv
+
+	nodeID string
 
 	rsdClient *rsd.Client
 
@@ -58,19 +96,33 @@ type Driver struct {
 }
 
 // NewDriver returns a CSI plugin that contains the necessary gRPC
-// interfaces to interact with Kubernetes over unix domain socket
-func NewDriver(ep string, rsdClient *rsd.Client) *Driver {
+// interfaces to interact with Kubernetes over unix domain socket(s).
+//
+// mode selects which services are registered and on which endpoint:
+// ModeController only serves controllerEndpoint, ModeNode only serves
+// nodeEndpoint, and ModeAll serves both, on separate sockets if the two
+// endpoints differ or combined onto one socket if they're equal. nodeID is
+// only meaningful in ModeNode and ModeAll and is returned from
+// NodeGetInfo. csiAddonsEndpoint, if non-empty, serves the CSI-Addons
+// out-of-band operations (ReclaimSpace, NetworkFence) on a third socket;
+// leave it empty to disable the CSI-Addons endpoint.
+func NewDriver(controllerEndpoint, nodeEndpoint, csiAddonsEndpoint, nodeID string, mode Mode, rsdClient *rsd.Client) *Driver {
 	return &Driver{
-		endpoint:  ep,
-		rsdClient: rsdClient,
+		mode:               mode,
+		controllerEndpoint: controllerEndpoint,
+		nodeEndpoint:       nodeEndpoint,
+		csiAddonsEndpoint:  csiAddonsEndpoint,
+		nodeID:             nodeID,
+		rsdClient:          rsdClient,
 	}
 }
 
-// Run starts the CSI plugin by communication over the given endpoint
-func (drv *Driver) Run() error {
-	u, err := url.Parse(drv.endpoint)
+// listen parses a unix:// endpoint, removes any stale socket left behind by
+// a previous run, and binds a listener to it.
+func listen(endpoint string) (net.Listener, error) {
+	u, err := url.Parse(endpoint)
 	if err != nil {
-		return fmt.Errorf("unable to parse address: %q", err)
+		return nil, fmt.Errorf("unable to parse address: %q", err)
 	}
 
 	spath := path.Join(u.Host, filepath.FromSlash(u.Path))
@@ -80,7 +132,7 @@ func (drv *Driver) Run() error {
 
 	// CSI plugins talk only over UNIX sockets currently
 	if u.Scheme != "unix" {
-		return fmt.Errorf("currently only unix domain sockets are supported, have: %s", u.Scheme)
+		return nil, fmt.Errorf("currently only unix domain sockets are supported, have: %s", u.Scheme)
 	}
 
 	// remove the socket if it's already there. This can happen if we
@@ -89,30 +141,196 @@ func (drv *Driver) Run() error {
 	if _, err = os.Stat(spath); !os.IsNotExist(err) {
 		log.Printf("removing socket %s", spath)
 		if err = os.Remove(spath); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("failed to remove unix domain socket file %s, error: %s", spath, err)
+			return nil, fmt.Errorf("failed to remove unix domain socket file %s, error: %s", spath, err)
 		}
 	}
 
 	listener, err := net.Listen(u.Scheme, spath)
 	if err != nil {
-		return fmt.Errorf("failed to listen socket %s: %v", spath, err)
+		return nil, fmt.Errorf("failed to listen socket %s: %v", spath, err)
+	}
+	return listener, nil
+}
+
+// bind binds a gRPC server with the given services to endpoint. The server
+// is returned already listening, but not yet serving; call Serve on the
+// returned listener to start accepting RPCs.
+func bind(endpoint string, register func(*grpc.Server)) (*grpc.Server, net.Listener, error) {
+	listener, err := listen(endpoint)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// log response errors
-	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(logInterceptor))
+	register(srv)
+	return srv, listener, nil
+}
+
+// bound pairs a gRPC server with the listener it was bound to, so Run can
+// serve it and, on a partial bind failure, tear it back down.
+type bound struct {
+	endpoint string
+	srv      *grpc.Server
+	listener net.Listener
+}
+
+// closeAll stops every already-bound server. It is used to unwind a
+// partial Run() when a later bind() call fails, so we don't leak fds or
+// leave stale socket files behind that would otherwise only get cleaned up
+// on the next process restart.
+func closeAll(targets []bound) {
+	for _, t := range targets {
+		t.srv.Stop()
+		// The server has not called Serve yet, so Stop does not own the
+		// listener; close it here.
+		t.listener.Close()
+	}
+}
+
+// Run starts the CSI plugin, binding one, two, or three unix domain sockets
+// depending on drv.mode and whether a CSI-Addons endpoint is configured,
+// and blocks until all of them have stopped serving.
+//
+// When controllerEndpoint and nodeEndpoint are the same path, a single
+// combined Identity+Controller+Node server is bound instead of binding the
+// same path twice, which would otherwise silently orphan the first listener
+// and leave Controller RPCs unreachable.
+func (drv *Driver) Run() error {
+	switch drv.mode {
+	case ModeController, ModeNode, ModeAll:
+	default:
+		return fmt.Errorf("unknown driver mode %q: must be one of %q, %q, %q", drv.mode, ModeController, ModeNode, ModeAll)
+	}
+
+	var targets []bound
+
+	if drv.mode == ModeAll && drv.controllerEndpoint == drv.nodeEndpoint {
+		srv, listener, err := bind(drv.controllerEndpoint, func(s *grpc.Server) {
+			csi.RegisterIdentityServer(s, drv)
+			csi.RegisterControllerServer(s, drv)
+			csi.RegisterNodeServer(s, drv)
+		})
 		if err != nil {
-			log.Fatalf("method %s failed", info.FullMethod)
+			closeAll(targets)
+			return err
+		}
+		drv.srvMu.Lock()
+		drv.controllerSrv = srv
+		drv.nodeSrv = srv
+		drv.srvMu.Unlock()
+		targets = append(targets, bound{drv.controllerEndpoint, srv, listener})
+	} else {
+		if drv.mode == ModeController || drv.mode == ModeAll {
+			srv, listener, err := bind(drv.controllerEndpoint, func(s *grpc.Server) {
+				csi.RegisterIdentityServer(s, drv)
+				csi.RegisterControllerServer(s, drv)
+			})
+			if err != nil {
+				closeAll(targets)
+				return err
+			}
+			drv.srvMu.Lock()
+			drv.controllerSrv = srv
+			drv.srvMu.Unlock()
+			targets = append(targets, bound{drv.controllerEndpoint, srv, listener})
+		}
+		if drv.mode == ModeNode || drv.mode == ModeAll {
+			srv, listener, err := bind(drv.nodeEndpoint, func(s *grpc.Server) {
+				csi.RegisterIdentityServer(s, drv)
+				csi.RegisterNodeServer(s, drv)
+			})
+			if err != nil {
+				closeAll(targets)
+				return err
+			}
+			drv.srvMu.Lock()
+			drv.nodeSrv = srv
+			drv.srvMu.Unlock()
+			targets = append(targets, bound{drv.nodeEndpoint, srv, listener})
 		}
-		return resp, err
+	}
+	if drv.csiAddonsEndpoint != "" {
+		srv, listener, err := bind(drv.csiAddonsEndpoint, func(s *grpc.Server) {
+			identity.RegisterIdentityServer(s, drv)
+			reclaimspace.RegisterReclaimSpaceServer(s, drv)
+			fence.RegisterFenceServer(s, drv)
+		})
+		if err != nil {
+			closeAll(targets)
+			return err
+		}
+		drv.srvMu.Lock()
+		drv.csiAddonsSrv = srv
+		drv.srvMu.Unlock()
+		targets = append(targets, bound{drv.csiAddonsEndpoint, srv, listener})
 	}
 
-	drv.srv = grpc.NewServer(grpc.UnaryInterceptor(errHandler))
-	csi.RegisterIdentityServer(drv.srv, drv)
-	csi.RegisterControllerServer(drv.srv, drv)
-	//csi.RegisterNodeServer(drv.srv, drv)
-
+	drv.readyMu.Lock()
 	drv.ready = true
-	log.Printf("server started serving on %s", drv.endpoint)
-	return drv.srv.Serve(listener)
-}
\ No newline at end of file
+	drv.readyMu.Unlock()
+
+	errCh := make(chan error, len(targets))
+	for _, t := range targets {
+		t := t
+		go func() {
+			log.Printf("server started serving on %s", t.endpoint)
+			errCh <- t.srv.Serve(t.listener)
+		}()
+	}
+
+	var firstErr error
+	for range targets {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Stop drains and shuts down every gRPC server started by Run. It first
+// marks the driver not-ready, so Identity.Probe starts failing and the
+// kubelet/external-attacher stop sending new RPCs, then asks each server to
+// stop gracefully. If ctx is cancelled or its deadline passes before a
+// server has drained its in-flight RPCs, that server is killed immediately
+// instead.
+func (drv *Driver) Stop(ctx context.Context) error {
+	drv.readyMu.Lock()
+	drv.ready = false
+	drv.readyMu.Unlock()
+
+	drv.srvMu.Lock()
+	srvs := []*grpc.Server{drv.controllerSrv, drv.nodeSrv, drv.csiAddonsSrv}
+	drv.srvMu.Unlock()
+
+	seen := make(map[*grpc.Server]bool, len(srvs))
+	var wg sync.WaitGroup
+	for _, srv := range srvs {
+		// In the combined-socket deployment controllerSrv and nodeSrv are
+		// the same *grpc.Server; stop it only once.
+		if srv == nil || seen[srv] {
+			continue
+		}
+		seen[srv] = true
+		wg.Add(1)
+		go func(srv *grpc.Server) {
+			defer wg.Done()
+
+			stopped := make(chan struct{})
+			go func() {
+				srv.GracefulStop()
+				close(stopped)
+			}()
+
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				log.Printf("graceful stop deadline exceeded, forcing shutdown")
+				srv.Stop()
+				<-stopped
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2019 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csirsd
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+)
+
+// slowService is a minimal hand-rolled gRPC service with a single unary
+// method that blocks until release is closed, used to simulate an
+// in-flight RPC (e.g. a long-running CreateVolume) during a graceful
+// shutdown test.
+type slowService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowService) handle(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+	close(s.started)
+	<-s.release
+	return &csi.GetPluginInfoResponse{}, nil
+}
+
+func (s *slowService) serviceDesc() *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{
+		ServiceName: "test.Slow",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{
+				MethodName: "Do",
+				Handler: func(srvIface interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+					return s.handle(srvIface, ctx, dec, interceptor)
+				},
+			},
+		},
+		Streams:  []grpc.StreamDesc{},
+		Metadata: "test.proto",
+	}
+}
+
+// TestStopDrainsInFlightRPC verifies that Stop waits for an in-flight RPC to
+// complete (GracefulStop) rather than tearing down the connection out from
+// under it, mirroring what happens when kubelet sends SIGTERM mid-request.
+func TestStopDrainsInFlightRPC(t *testing.T) {
+	svc := &slowService{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+
+	sockPath := filepath.Join(t.TempDir(), "test.sock")
+	listener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	srv := grpc.NewServer()
+	srv.RegisterService(svc.serviceDesc(), svc)
+
+	drv := &Driver{nodeSrv: srv}
+
+	go func() {
+		if err := srv.Serve(listener); err != nil {
+			t.Logf("server stopped serving: %v", err)
+		}
+	}()
+
+	conn, err := grpc.Dial("unix://"+sockPath, grpc.WithInsecure(), grpc.WithBlock(), grpc.WithTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	rpcDone := make(chan error, 1)
+	go func() {
+		var reply csi.GetPluginInfoResponse
+		rpcDone <- conn.Invoke(context.Background(), "/test.Slow/Do", &csi.GetPluginInfoRequest{}, &reply)
+	}()
+
+	select {
+	case <-svc.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RPC did not reach the handler in time")
+	}
+
+	stopDone := make(chan error, 1)
+	go func() {
+		stopDone <- drv.Stop(context.Background())
+	}()
+
+	// Stop must not return while the RPC is still in flight.
+	select {
+	case <-stopDone:
+		t.Fatal("Stop returned before the in-flight RPC completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(svc.release)
+
+	select {
+	case err := <-rpcDone:
+		if err != nil {
+			t.Fatalf("in-flight RPC failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("in-flight RPC never completed")
+	}
+
+	select {
+	case err := <-stopDone:
+		if err != nil {
+			t.Fatalf("Stop returned an error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop did not return after the RPC drained")
+	}
+}
+
+// TestRunCombinedSocketServesControllerAndNode is a regression test for the
+// bug fixed in a previous commit where, in the default single-socket
+// deployment (controllerEndpoint == nodeEndpoint), Run bound the same path
+// twice and silently orphaned the first listener, leaving the Controller
+// service unreachable. It asserts both the Controller and Node services are
+// reachable over the one combined socket.
+func TestRunCombinedSocketServesControllerAndNode(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "csi.sock")
+	endpoint := "unix://" + sockPath
+
+	drv := NewDriver(endpoint, endpoint, "", "test-node", ModeAll, nil)
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- drv.Run()
+	}()
+	defer drv.Stop(context.Background())
+
+	var conn *grpc.ClientConn
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		conn, err = grpc.Dial("unix://"+sockPath, grpc.WithInsecure())
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to dial combined socket: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err := csi.NewNodeClient(conn).NodeGetCapabilities(ctx, &csi.NodeGetCapabilitiesRequest{}); err != nil {
+		t.Errorf("NodeGetCapabilities over combined socket failed: %v", err)
+	}
+	if _, err := csi.NewControllerClient(conn).ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{}); err != nil {
+		t.Errorf("ControllerGetCapabilities over combined socket failed: %v", err)
+	}
+
+	select {
+	case err := <-runDone:
+		t.Fatalf("Run returned unexpectedly: %v", err)
+	default:
+	}
+}
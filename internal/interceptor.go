@@ -0,0 +1,44 @@
+// Copyright 2019 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csirsd
+
+import (
+	"time"
+
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+)
+
+// logInterceptor is a grpc.UnaryServerInterceptor that logs method name,
+// request, response and error for every RPC at a verbosity operators can
+// tune with --v, and always returns the handler's error to the caller
+// instead of killing the server.
+func logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	klog.V(3).Infof("%s called with request: %s", info.FullMethod, protosanitizer.StripSecrets(req))
+
+	resp, err := handler(ctx, req)
+
+	duration := time.Since(start)
+	if err != nil {
+		klog.Errorf("%s failed in %s: %v", info.FullMethod, duration, err)
+	} else {
+		klog.V(3).Infof("%s succeeded in %s with response: %s", info.FullMethod, duration, protosanitizer.StripSecrets(resp))
+	}
+
+	return resp, err
+}
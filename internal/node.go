@@ -0,0 +1,288 @@
+// Copyright 2019 Intel Corporation. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package csirsd
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/intel/csi-intel-rsd/pkg/rsd"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+	mount "k8s.io/mount-utils"
+)
+
+// nvmeConnect issues `nvme connect` against the NVMe-oF target that exposes
+// the RSD-provisioned volume and returns the resulting block device path.
+func nvmeConnect(endpoint *rsd.Endpoint) (string, error) {
+	args := []string{
+		"connect",
+		"--transport", endpoint.Transport,
+		"--traddr", endpoint.Address,
+		"--trsvcid", endpoint.Port,
+		"--nqn", endpoint.NQN,
+	}
+	if out, err := osexec.Command("nvme", args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("nvme connect failed: %v: %s", err, out)
+	}
+
+	return endpoint.DevicePath()
+}
+
+// nvmeDisconnect tears down the NVMe-oF session for the given NQN, returning
+// the underlying command error (if any) so the caller can decide whether a
+// failed disconnect should fail the RPC.
+func nvmeDisconnect(nqn string) error {
+	out, err := osexec.Command("nvme", "disconnect", "--nqn", nqn).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nvme disconnect failed: %v: %s", err, out)
+	}
+	return nil
+}
+
+// NodeStageVolume mounts the volume to a staging path on the node. This is
+// where the RSD-provisioned block device is discovered via NVMe-oF,
+// formatted (for Mount volumes) and mounted.
+func (drv *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+
+	endpoint, err := drv.rsdClient.GetVolumeEndpoint(ctx, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up RSD endpoint for volume %s: %v", volumeID, err)
+	}
+
+	// NodeStageVolume must be idempotent: kubelet retries it against an
+	// already-staged volume (e.g. after a kubelet restart). If the NQN is
+	// already connected, DevicePath resolves the existing block device and
+	// we skip nvmeConnect instead of creating a second NVMe-oF session.
+	devicePath, err := endpoint.DevicePath()
+	if err != nil {
+		devicePath, err = nvmeConnect(endpoint)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to connect volume %s: %v", volumeID, err)
+		}
+	}
+
+	if block := volCap.GetBlock(); block != nil {
+		// Block volumes are staged as-is; the device node itself is bind
+		// mounted into the target path in NodePublishVolume.
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mnt := volCap.GetMount()
+	fsType := mnt.GetFsType()
+	if fsType == "" {
+		fsType = "ext4"
+	}
+
+	mounter := mount.New("")
+	notMnt, err := mount.IsNotMountPoint(mounter, stagingPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(stagingPath, 0750); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to create staging path %s: %v", stagingPath, err)
+			}
+			notMnt = true
+		} else {
+			return nil, status.Errorf(codes.Internal, "failed to check staging path %s: %v", stagingPath, err)
+		}
+	}
+	if !notMnt {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	formatter := mount.NewSafeFormatAndMount(mounter, exec.New())
+	if err := formatter.FormatAndMount(devicePath, stagingPath, fsType, mnt.GetMountFlags()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to format and mount %s at %s: %v", devicePath, stagingPath, err)
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the staging path and disconnects the NVMe-oF
+// session for the volume.
+func (drv *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	mounter := mount.New("")
+	if err := mount.CleanupMountPoint(stagingPath, mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount staging path %s: %v", stagingPath, err)
+	}
+
+	endpoint, err := drv.rsdClient.GetVolumeEndpoint(ctx, volumeID)
+	if err != nil {
+		// Volume may already have been detached on the RSD side; nothing
+		// left to disconnect.
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+	if err := nvmeDisconnect(endpoint.NQN); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disconnect volume %s: %v", volumeID, err)
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind mounts the staged volume (or device, for block
+// volumes) into the target path that is consumed by the workload container.
+func (drv *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+
+	mountFlags := []string{"bind"}
+	if req.GetReadonly() {
+		mountFlags = append(mountFlags, "ro")
+	}
+
+	source := req.GetStagingTargetPath()
+	if block := volCap.GetBlock(); block != nil {
+		endpoint, err := drv.rsdClient.GetVolumeEndpoint(ctx, volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to look up RSD endpoint for volume %s: %v", volumeID, err)
+		}
+		devicePath, err := endpoint.DevicePath()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resolve device path for volume %s: %v", volumeID, err)
+		}
+		source = devicePath
+		if err := os.MkdirAll(path.Dir(targetPath), 0750); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create parent of target path %s: %v", targetPath, err)
+		}
+		if _, err := os.Create(targetPath); err != nil && !os.IsExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to create target file %s: %v", targetPath, err)
+		}
+	} else if source == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	} else if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create target path %s: %v", targetPath, err)
+	}
+
+	mounter := mount.New("")
+	notMnt, err := mount.IsNotMountPoint(mounter, targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check target path %s: %v", targetPath, err)
+	}
+	if !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := mounter.Mount(source, targetPath, "", mountFlags); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to bind mount %s to %s: %v", source, targetPath, err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume removes the bind mount created by NodePublishVolume.
+func (drv *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+
+	mounter := mount.New("")
+	if err := mount.CleanupMountPoint(targetPath, mounter, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount target path %s: %v", targetPath, err)
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetInfo returns the node ID that ControllerPublishVolume uses to route
+// attach operations to the initiator running on this node.
+func (drv *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId: drv.nodeID,
+	}, nil
+}
+
+// NodeGetCapabilities returns the capabilities of the node service.
+func (drv *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	caps := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+	}
+
+	var nscaps []*csi.NodeServiceCapability
+	for _, c := range caps {
+		nscaps = append(nscaps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: nscaps}, nil
+}
+
+// NodeGetVolumeStats returns usage statistics for the volume mounted at
+// volumePath.
+func (drv *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to statfs %s: %v", volumePath, err)
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * int64(statfs.Bsize),
+				Available: int64(statfs.Bavail) * int64(statfs.Bsize),
+				Used:      int64(statfs.Blocks-statfs.Bfree) * int64(statfs.Bsize),
+			},
+		},
+	}, nil
+}